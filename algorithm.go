@@ -0,0 +1,257 @@
+package bizapi
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Algorithm identifies a signing/verification scheme supported by this
+// package.  SignRequest carries it in signed URLs as the "alg" query
+// parameter so that AuthenticateRequest can pick the matching Verifier.
+// SignUrl does not attach "alg", and Authenticate verifies only
+// HMACSHA1 clients.  It is also tagged onto each KeyRepository entry so
+// that a URL whose "alg" disagrees with what is configured for its
+// client is rejected outright by both Authenticate and
+// AuthenticateRequest.
+type Algorithm string
+
+const (
+	// HMACSHA1 is the original, and still default, algorithm: a shared
+	// secret used with HMAC-SHA1.
+	HMACSHA1 Algorithm = "HMAC-SHA1"
+	// HMACSHA256 is a shared secret used with HMAC-SHA256.
+	HMACSHA256 Algorithm = "HMAC-SHA256"
+	// RSASHA256 is RSA PKCS#1 v1.5 signing over a SHA-256 digest.  The
+	// KeyRepository entry for a client using this algorithm holds only
+	// the client's RSA public key.
+	RSASHA256 Algorithm = "RSA-SHA256"
+	// Ed25519 is Ed25519 signing.  The KeyRepository entry for a client
+	// using this algorithm holds only the client's Ed25519 public key.
+	Ed25519 Algorithm = "Ed25519"
+)
+
+// Signer computes a signature over data using a client's private
+// material: a shared secret for the HMAC algorithms, or a private key
+// for the asymmetric ones.
+type Signer interface {
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier checks whether signature is a valid signature of data using
+// a client's public material: the same shared secret used to sign for
+// the HMAC algorithms, or a public key for the asymmetric ones.  It
+// returns a non-nil error if signature does not verify.
+type Verifier interface {
+	Verify(data, signature []byte) error
+}
+
+// hmacSignerVerifier implements both Signer and Verifier for the HMAC
+// algorithms: signing and verifying a shared secret both just mean
+// recomputing the HMAC and comparing.
+type hmacSignerVerifier struct {
+	newHash func() hash.Hash
+	secret  []byte
+}
+
+func (h hmacSignerVerifier) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(h.newHash, h.secret)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (h hmacSignerVerifier) Verify(data, signature []byte) error {
+	expected, _ := h.Sign(data)
+	if !hmac.Equal(expected, signature) {
+		return errors.New("HMAC signature does not match")
+	}
+	return nil
+}
+
+type rsaSigner struct{ private *rsa.PrivateKey }
+
+func (s rsaSigner) Sign(data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, s.private, crypto.SHA256, hashed[:])
+}
+
+type rsaVerifier struct{ public *rsa.PublicKey }
+
+func (v rsaVerifier) Verify(data, signature []byte) error {
+	hashed := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(v.public, crypto.SHA256, hashed[:], signature)
+}
+
+type ed25519Signer struct{ private ed25519.PrivateKey }
+
+func (s ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.private, data), nil
+}
+
+type ed25519Verifier struct{ public ed25519.PublicKey }
+
+func (v ed25519Verifier) Verify(data, signature []byte) error {
+	if !ed25519.Verify(v.public, data, signature) {
+		return errors.New("Ed25519 signature does not verify")
+	}
+	return nil
+}
+
+// NewSigner returns a Signer for alg using key, a blob as returned by
+// the corresponding half of GenerateKey: the shared secret for the HMAC
+// algorithms, or the private key for the asymmetric ones.
+func NewSigner(alg Algorithm, key string) (Signer, error) {
+	switch alg {
+	case HMACSHA1:
+		secret, e := DecodeUrlSafeBase64(key)
+		if e != nil {
+			return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+		}
+		return hmacSignerVerifier{sha1.New, secret}, nil
+	case HMACSHA256:
+		secret, e := DecodeUrlSafeBase64(key)
+		if e != nil {
+			return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+		}
+		return hmacSignerVerifier{sha256.New, secret}, nil
+	case RSASHA256:
+		private, e := decodeRSAPrivateKey(key)
+		if e != nil {
+			return nil, e
+		}
+		return rsaSigner{private}, nil
+	case Ed25519:
+		decoded, e := DecodeUrlSafeBase64(key)
+		if e != nil {
+			return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+		}
+		if len(decoded) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("Ed25519 private key must be %d bytes, got %d", ed25519.PrivateKeySize, len(decoded))
+		}
+		return ed25519Signer{ed25519.PrivateKey(decoded)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+}
+
+// NewVerifier returns a Verifier for alg using key: the shared secret
+// for the HMAC algorithms, or the public key for the asymmetric ones.
+func NewVerifier(alg Algorithm, key string) (Verifier, error) {
+	switch alg {
+	case HMACSHA1:
+		secret, e := DecodeUrlSafeBase64(key)
+		if e != nil {
+			return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+		}
+		return hmacSignerVerifier{sha1.New, secret}, nil
+	case HMACSHA256:
+		secret, e := DecodeUrlSafeBase64(key)
+		if e != nil {
+			return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+		}
+		return hmacSignerVerifier{sha256.New, secret}, nil
+	case RSASHA256:
+		public, e := decodeRSAPublicKey(key)
+		if e != nil {
+			return nil, e
+		}
+		return rsaVerifier{public}, nil
+	case Ed25519:
+		decoded, e := DecodeUrlSafeBase64(key)
+		if e != nil {
+			return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+		}
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(decoded))
+		}
+		return ed25519Verifier{ed25519.PublicKey(decoded)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+}
+
+// GenerateKey generates a new signing key for alg.  For the HMAC
+// algorithms it returns a random shared secret and an empty public key
+// blob, since there is nothing to distribute.  For the asymmetric
+// algorithms it returns a private key blob for the signer and a
+// distributable public key blob for everyone else's KeyRepository.
+// Both blobs are URL-safe base64 encoded.
+func GenerateKey(alg Algorithm) (privateKeyBlob, publicKeyBlob string, err error) {
+	switch alg {
+	case HMACSHA1, HMACSHA256:
+		secret := make([]byte, 32)
+		if _, e := rand.Read(secret); e != nil {
+			return "", "", fmt.Errorf("rand.Read failed: %v", e)
+		}
+		return EncodeUrlSafeBase64(secret), "", nil
+	case RSASHA256:
+		// 2048 bits, not the 128 bits this package used to generate,
+		// which was never strong enough to be a real RSA key.
+		private, e := rsa.GenerateKey(rand.Reader, 2048)
+		if e != nil {
+			return "", "", fmt.Errorf("rsa.GenerateKey failed: %v", e)
+		}
+		privateBlob := EncodeUrlSafeBase64(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(private),
+		}))
+		publicBytes, e := x509.MarshalPKIXPublicKey(&private.PublicKey)
+		if e != nil {
+			return "", "", fmt.Errorf("x509.MarshalPKIXPublicKey failed: %v", e)
+		}
+		publicBlob := EncodeUrlSafeBase64(pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: publicBytes,
+		}))
+		return privateBlob, publicBlob, nil
+	case Ed25519:
+		public, private, e := ed25519.GenerateKey(rand.Reader)
+		if e != nil {
+			return "", "", fmt.Errorf("ed25519.GenerateKey failed: %v", e)
+		}
+		return EncodeUrlSafeBase64(private), EncodeUrlSafeBase64(public), nil
+	default:
+		return "", "", fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+}
+
+func decodeRSAPrivateKey(key string) (*rsa.PrivateKey, error) {
+	decoded, e := DecodeUrlSafeBase64(key)
+	if e != nil {
+		return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+	}
+	block, _ := pem.Decode(decoded)
+	if block == nil {
+		return nil, errors.New("failed to PEM-decode RSA private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func decodeRSAPublicKey(key string) (*rsa.PublicKey, error) {
+	decoded, e := DecodeUrlSafeBase64(key)
+	if e != nil {
+		return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+	}
+	block, _ := pem.Decode(decoded)
+	if block == nil {
+		return nil, errors.New("failed to PEM-decode RSA public key")
+	}
+	public, e := x509.ParsePKIXPublicKey(block.Bytes)
+	if e != nil {
+		return nil, fmt.Errorf("x509.ParsePKIXPublicKey failed: %v", e)
+	}
+	rsaPublic, ok := public.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("PEM block does not contain an RSA public key")
+	}
+	return rsaPublic, nil
+}
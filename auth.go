@@ -8,19 +8,15 @@
 package bizapi
 
 import (
-	"bufio"
 	"crypto/hmac"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha1"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // EncodeUrlSafeBase64 encodes a URL using base64 and then with "+"
@@ -42,29 +38,17 @@ func DecodeUrlSafeBase64(wiered string) ([]byte, error) {
 	return encoded, nil
 }
 
-// GenerateKey invokes crypto.rsa.GenerateKey to randomly generate a
-// key for signing request URLs.  The returned key was URL-safe base64
-// encoded, and can be used by CreateSignature to sign a URL.
-func GenerateKey() (string, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 128)
-	if err != nil {
-		return "", fmt.Errorf("rsa.GeneratedKey failed: %v", err)
-	}
-
-	encodedPrivateKey := EncodeUrlSafeBase64(
-		pem.EncodeToMemory(
-			&pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-			}))
-
-	return encodedPrivateKey, nil
-}
-
 // CreateSignature computes a signature of the path and raw query part
 // of an URL, where key should be a string generated by
-// EncodeUrlSafeBase64.
-func CreateSignature(requestUrl *url.URL, key string) (string, error) {
+// EncodeUrlSafeBase64.  If expires is non-zero, the signature also
+// covers an "expires" query parameter carrying its Unix timestamp, so
+// that Authenticate can reject the URL once it has passed.  If nonce is
+// non-empty, the signature covers a "nonce" query parameter too, so
+// that Authenticate can reject replays via a NonceStore.  Pass a zero
+// time.Time and an empty nonce to sign a URL without expiration or
+// replay protection, or to re-derive the signature of a URL that
+// already carries literal "expires"/"nonce" query parameters.
+func CreateSignature(requestUrl *url.URL, key string, expires time.Time, nonce string) (string, error) {
 	values, err := url.ParseQuery(requestUrl.RawQuery)
 	if err != nil {
 		return "", fmt.Errorf("url.ParseQuery failed: %v", err)
@@ -78,6 +62,12 @@ func CreateSignature(requestUrl *url.URL, key string) (string, error) {
 
 	// Important: url.Values.Encode() sorts values by their keys.
 	urlToSign := requestUrl.Path + "?" + requestUrl.RawQuery
+	if !expires.IsZero() {
+		urlToSign += fmt.Sprintf("&expires=%d", expires.Unix())
+	}
+	if nonce != "" {
+		urlToSign += "&nonce=" + nonce
+	}
 
 	decodedKey, err := DecodeUrlSafeBase64(key)
 	if err != nil {
@@ -114,52 +104,82 @@ func CheckSignedUrl(rawUrl string) (*url.URL, url.Values, error) {
 // with the URL as a parameter in the format of
 // "&signature=<computed-signature".  It is important that the URL
 // also contains a "client" parameter, which will be used by
-// Authenticate to retrieved the key of the client.
-func SignUrl(rawUrl, key string) (string, error) {
+// Authenticate to retrieved the key of the client.  If expires is
+// non-zero, an "expires" parameter carrying its Unix timestamp is
+// attached and signed alongside "client", and Authenticate will reject
+// the URL once that time has passed.  If nonce is non-empty, a "nonce"
+// parameter is attached and signed too, letting Authenticate reject
+// replays via a NonceStore.  Pass a zero time.Time and an empty nonce
+// to sign a plain URL, as before.
+func SignUrl(rawUrl, key string, expires time.Time, nonce string) (string, error) {
 	url, e := url.Parse(rawUrl)
 	if e != nil {
 		return "", fmt.Errorf("url.Parse(rawUrl=%s) failed: %v", rawUrl, e)
 	}
-	signature, e := CreateSignature(url, key)
+	signature, e := CreateSignature(url, key, expires, nonce)
 	if e != nil {
 		return "", fmt.Errorf("CreateSignature(url=%s, key=%s) failed: %v", url, key, e)
 	}
-	return url.Scheme + "://" + url.Host + url.Path + "?" + url.RawQuery + "&signature=" + signature, nil
-}
-
-type KeyRepository map[string]string
-
-// LoadKeyRepository loads client ID and key pairs.  Then people can
-// call Authenticate to check whether a request URL is valid.
-func LoadKeyRepository(reader io.Reader) (KeyRepository, error) {
-	repo := make(map[string]string)
-	s := bufio.NewScanner(reader)
-	for s.Scan() {
-		line := s.Text()
-		if len(line) == 0 || line[0] == '#' {
-			continue
-		}
-		fields := strings.Split(line, " ")
-		if len(fields) != 2 {
-			return nil, fmt.Errorf("Every line must contains two fields separated by a space: %s", line)
-		}
-		repo[fields[0]] = fields[1]
+	signedUrl := url.Scheme + "://" + url.Host + url.Path + "?" + url.RawQuery
+	if !expires.IsZero() {
+		signedUrl += fmt.Sprintf("&expires=%d", expires.Unix())
 	}
-	return repo, nil
+	if nonce != "" {
+		signedUrl += "&nonce=" + nonce
+	}
+	return signedUrl + "&signature=" + signature, nil
 }
 
 // Autheticate checks that the signature parameter in the request URL
-// comfront the client parameter.  If it returns no error, the caller
-// can find client ID in returned url.Values value.
-func (c KeyRepository) Authenticate(rawUrl string) (*url.URL, url.Values, error) {
+// comfront the client parameter, that "expires" (if present) has not
+// passed, and that "nonce" (if present) has not been seen before.
+// clock decides what "now" is for the expiration check; pass nil to use
+// the real wall clock.  nonces is consulted for replay protection; pass
+// nil to skip it (e.g. for signed URLs that never carry a nonce).  If
+// "kid" is present, it selects which of the client's (possibly rotated)
+// keys to verify against; otherwise the client's default ("" kid) key
+// is used.  If it returns no error, the caller can find client ID in
+// returned url.Values value.  store is consulted via KeyRepositoryStore,
+// so a caller can back it with a database or a KMS instead of an
+// in-memory KeyRepository.
+func Authenticate(store KeyRepositoryStore, rawUrl string, clock Clock, nonces NonceStore) (*url.URL, url.Values, error) {
 	parsedUrl, values, e := CheckSignedUrl(rawUrl)
 	if e != nil {
 		return nil, nil, fmt.Errorf("CheckSignedUrl failed: %v", e)
 	}
 
-	key, present := c[values["client"][0]]
-	if !present {
-		return nil, nil, fmt.Errorf("Unknown client: %s", values["client"])
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	var kid string
+	if v, present := values["kid"]; present && len(v) == 1 {
+		kid = v[0]
+	}
+	entry, e := lookupKey(store, values["client"][0], kid, clock.Now())
+	if e != nil {
+		return nil, nil, e
+	}
+	if v, present := values["alg"]; present && len(v) == 1 && Algorithm(v[0]) != entry.algorithm() {
+		return nil, nil, fmt.Errorf("alg %q does not match the algorithm configured for client %s",
+			v[0], values["client"][0])
+	}
+	if entry.algorithm() != HMACSHA1 {
+		return nil, nil, fmt.Errorf("client %s is configured for %s; use AuthenticateRequest instead",
+			values["client"][0], entry.algorithm())
+	}
+	key := entry.Key
+
+	var expires time.Time
+	if v, present := values["expires"]; present && len(v) == 1 {
+		unix, e := strconv.ParseInt(v[0], 10, 64)
+		if e != nil {
+			return nil, nil, fmt.Errorf("invalid expires query %q: %v", v[0], e)
+		}
+		expires = time.Unix(unix, 0)
+		if clock.Now().After(expires) {
+			return nil, nil, fmt.Errorf("signed URL expired at %v", expires)
+		}
 	}
 
 	attachedSignature := values["signature"][0]
@@ -173,7 +193,7 @@ func (c KeyRepository) Authenticate(rawUrl string) (*url.URL, url.Values, error)
 	if e != nil {
 		return nil, nil, fmt.Errorf("url.Parse failed: %v", e)
 	}
-	signature, e := CreateSignature(urlWithoutSignature, key)
+	signature, e := CreateSignature(urlWithoutSignature, key, time.Time{}, "")
 	if e != nil {
 		return nil, nil, fmt.Errorf("CreateSignature failed: %v", e)
 	}
@@ -182,5 +202,27 @@ func (c KeyRepository) Authenticate(rawUrl string) (*url.URL, url.Values, error)
 		return nil, nil, fmt.Errorf("Attached signature %s is not equal to computed signature %s",
 			attachedSignature, signature)
 	}
+
+	// Only an authenticated request gets to consume a nonce slot: a
+	// forged request with a bad signature must not be able to mark a
+	// nonce as seen and so lock out the legitimate, correctly-signed
+	// request that uses it.
+	if v, present := values["nonce"]; present && len(v) == 1 && nonces != nil {
+		seen, e := nonces.Seen(v[0], expires)
+		if e != nil {
+			return nil, nil, fmt.Errorf("NonceStore.Seen failed: %v", e)
+		}
+		if seen {
+			return nil, nil, fmt.Errorf("nonce %q has already been used", v[0])
+		}
+	}
+
 	return parsedUrl, values, nil
 }
+
+// Authenticate is KeyRepository's convenience wrapper around the
+// package-level Authenticate, so callers with an in-memory repository
+// can call r.Authenticate(...) directly.
+func (c *KeyRepository) Authenticate(rawUrl string, clock Clock, nonces NonceStore) (*url.URL, url.Values, error) {
+	return Authenticate(c, rawUrl, clock, nonces)
+}
@@ -1,10 +1,12 @@
 package bizapi
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -14,9 +16,26 @@ var (
 	kFullSignedUrl = "http://maps.googleapis.com/maps/api/geocode/json?address=New+York&sensor=false&client=clientID&signature=KrU1TzVQM7Ur0i8i7K3huiw3MsA="
 )
 
+// fakeClock implements Clock and always reports a fixed time, so tests
+// that exercise expiration logic do not race against the wall clock.
+type fakeClock struct{ now time.Time }
+
+func (c fakeClock) Now() time.Time { return c.now }
+
+// newRepo builds a *KeyRepository with clientID configured with
+// entries, for tests that want a one-liner rather than NewKeyRepository
+// plus a series of Rotate calls.
+func newRepo(clientID string, entries ...KeyEntry) *KeyRepository {
+	r := NewKeyRepository()
+	for _, entry := range entries {
+		r.Rotate(clientID, entry)
+	}
+	return r
+}
+
 func TestCreateSignature(t *testing.T) {
 	u, _ := url.Parse(kUrl)
-	signature, err := CreateSignature(u, kPrivateKey)
+	signature, err := CreateSignature(u, kPrivateKey, time.Time{}, "")
 	if err != nil {
 		t.Errorf("CreateSignature failed: %v", err)
 	}
@@ -26,7 +45,7 @@ func TestCreateSignature(t *testing.T) {
 }
 
 func TestSignUrl(t *testing.T) {
-	signedUrl, err := SignUrl(kUrl, kPrivateKey)
+	signedUrl, err := SignUrl(kUrl, kPrivateKey, time.Time{}, "")
 	if err != nil {
 		t.Errorf("CreateSignature failed: %v", err)
 	}
@@ -37,21 +56,76 @@ func TestSignUrl(t *testing.T) {
 
 // TODO(wyi): better test or just remove it.
 func TestGenerateKey(t *testing.T) {
-	key, err := GenerateKey()
-	if err != nil {
-		t.Errorf("GenerateKey failed: %v", err)
+	for _, alg := range []Algorithm{HMACSHA1, HMACSHA256, RSASHA256, Ed25519} {
+		private, public, err := GenerateKey(alg)
+		if err != nil {
+			t.Errorf("GenerateKey(%s) failed: %v", alg, err)
+		}
+		fmt.Println(alg, len(private), len(public))
 	}
-	fmt.Println(len(key))
 }
 
 func TestLoadKeyRepository(t *testing.T) {
-	r := strings.NewReader("clientID vNIXE0xscrmjlyV-12Nj_BvUPaw=\nyiw something")
+	r := strings.NewReader("clientID vNIXE0xscrmjlyV-12Nj_BvUPaw=\nyiw something\nclientRSA RSA-SHA256 somePublicKeyBlob")
 	repo, e := LoadKeyRepository(r)
 	if e != nil {
 		t.Errorf("LoadKeyRepository failed.")
 	}
-	if len(repo) != 2 || repo["clientID"] != "vNIXE0xscrmjlyV-12Nj_BvUPaw=" || repo["yiw"] != "something" {
-		t.Errorf("Loaded wrong contents")
+	clientIDKeys, _ := repo.Keys("clientID")
+	yiwKeys, _ := repo.Keys("yiw")
+	clientRSAKeys, _ := repo.Keys("clientRSA")
+	if clientIDKeys[0] != (KeyEntry{Algorithm: HMACSHA1, Key: "vNIXE0xscrmjlyV-12Nj_BvUPaw="}) ||
+		yiwKeys[0] != (KeyEntry{Algorithm: HMACSHA1, Key: "something"}) ||
+		clientRSAKeys[0] != (KeyEntry{Algorithm: RSASHA256, Key: "somePublicKeyBlob"}) {
+		t.Errorf("Loaded wrong contents: clientID=%+v yiw=%+v clientRSA=%+v", clientIDKeys, yiwKeys, clientRSAKeys)
+	}
+}
+
+func TestLoadKeyRepositoryRotationFormat(t *testing.T) {
+	r := strings.NewReader(
+		"clientID keyA HMAC-SHA1 vNIXE0xscrmjlyV-12Nj_BvUPaw= 0 0\n" +
+			"clientID keyB HMAC-SHA1 something 1000 2000")
+	repo, e := LoadKeyRepository(r)
+	if e != nil {
+		t.Fatalf("LoadKeyRepository failed: %v", e)
+	}
+	entries, e := repo.Keys("clientID")
+	if e != nil {
+		t.Fatalf("Keys failed: %v", e)
+	}
+	if len(entries) != 2 ||
+		entries[0] != (KeyEntry{KeyID: "keyA", Algorithm: HMACSHA1, Key: "vNIXE0xscrmjlyV-12Nj_BvUPaw="}) ||
+		entries[1] != (KeyEntry{KeyID: "keyB", Algorithm: HMACSHA1, Key: "something",
+			NotBefore: time.Unix(1000, 0), NotAfter: time.Unix(2000, 0)}) {
+		t.Errorf("Loaded wrong contents: %+v", entries)
+	}
+}
+
+func TestKeyRepositoryRotate(t *testing.T) {
+	r := newRepo("clientID", KeyEntry{KeyID: "old", Algorithm: HMACSHA1, Key: kPrivateKey})
+	now := time.Unix(1000000, 0)
+
+	r.Rotate("clientID", KeyEntry{KeyID: "new", Algorithm: HMACSHA1, Key: "newKey", NotBefore: now})
+
+	if _, e := r.lookupKey("clientID", "old", now); e != nil {
+		t.Errorf("lookupKey rejected the still-valid old kid: %v", e)
+	}
+	if _, e := r.lookupKey("clientID", "new", now); e != nil {
+		t.Errorf("lookupKey rejected the newly rotated-in kid: %v", e)
+	}
+}
+
+func TestKeyRepositoryLookupKeyErrors(t *testing.T) {
+	r := newRepo("clientID", KeyEntry{KeyID: "retired", Algorithm: HMACSHA1, Key: kPrivateKey, NotAfter: time.Unix(1000, 0)})
+
+	if _, e := r.lookupKey("unknown", "", time.Unix(0, 0)); !errors.Is(e, ErrUnknownClient) {
+		t.Errorf("Expecting ErrUnknownClient, got %v", e)
+	}
+	if _, e := r.lookupKey("clientID", "wrong-kid", time.Unix(0, 0)); !errors.Is(e, ErrUnknownKeyID) {
+		t.Errorf("Expecting ErrUnknownKeyID, got %v", e)
+	}
+	if _, e := r.lookupKey("clientID", "retired", time.Unix(2000, 0)); !errors.Is(e, ErrKeyExpired) {
+		t.Errorf("Expecting ErrKeyExpired, got %v", e)
 	}
 }
 
@@ -68,13 +142,13 @@ func TestCheckSignedUrl(t *testing.T) {
 }
 
 func TestAuthenticate(t *testing.T) {
-	signedUrl, err := SignUrl(kUrl, kPrivateKey)
+	signedUrl, err := SignUrl(kUrl, kPrivateKey, time.Time{}, "")
 	if err != nil {
 		t.Errorf("CreateSignature failed: %v", err)
 	}
 
-	r := KeyRepository{"clientID": kPrivateKey}
-	_, values, e := r.Authenticate(signedUrl)
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	_, values, e := r.Authenticate(signedUrl, nil, nil)
 	if e != nil {
 		t.Errorf("Authenticate got unexpected error: %v", e)
 	}
@@ -82,8 +156,85 @@ func TestAuthenticate(t *testing.T) {
 		t.Errorf("No client ID found in the returned url.Values variable.")
 	}
 
-	r = KeyRepository{"clientID": "invalidBased64Key"}
-	if _, _, e := r.Authenticate(signedUrl); e == nil {
+	r = newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: "invalidBased64Key"})
+	if _, _, e := r.Authenticate(signedUrl, nil, nil); e == nil {
 		t.Errorf("Invalid based64-encoded key passed the check of Autheticate!: %v", e)
 	}
 }
+
+func TestAuthenticateExpiration(t *testing.T) {
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	now := time.Unix(1000000, 0)
+
+	signedUrl, err := SignUrl(kUrl, kPrivateKey, now.Add(time.Hour), "")
+	if err != nil {
+		t.Fatalf("SignUrl failed: %v", err)
+	}
+	if _, _, e := r.Authenticate(signedUrl, fakeClock{now}, nil); e != nil {
+		t.Errorf("Authenticate rejected a not-yet-expired URL: %v", e)
+	}
+	if _, _, e := r.Authenticate(signedUrl, fakeClock{now.Add(2 * time.Hour)}, nil); e == nil {
+		t.Errorf("Authenticate accepted a URL past its expires")
+	}
+}
+
+func TestAuthenticateNonceReplay(t *testing.T) {
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	nonces := NewMemoryNonceStore(nil)
+
+	signedUrl, err := SignUrl(kUrl, kPrivateKey, time.Time{}, "the-nonce")
+	if err != nil {
+		t.Fatalf("SignUrl failed: %v", err)
+	}
+	if _, _, e := r.Authenticate(signedUrl, nil, nonces); e != nil {
+		t.Errorf("Authenticate rejected a fresh nonce: %v", e)
+	}
+	if _, _, e := r.Authenticate(signedUrl, nil, nonces); e == nil {
+		t.Errorf("Authenticate accepted a replayed nonce")
+	}
+}
+
+// fakeKeyStore is a minimal KeyRepositoryStore backed by a single
+// hard-coded entry, standing in for a database- or KMS-backed
+// implementation in tests.
+type fakeKeyStore struct {
+	clientID string
+	entry    KeyEntry
+}
+
+func (s fakeKeyStore) Keys(clientID string) ([]KeyEntry, error) {
+	if clientID != s.clientID {
+		return nil, fmt.Errorf("client %q: %w", clientID, ErrUnknownClient)
+	}
+	return []KeyEntry{s.entry}, nil
+}
+
+func TestAuthenticateAgainstCustomKeyRepositoryStore(t *testing.T) {
+	signedUrl, err := SignUrl(kUrl, kPrivateKey, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("SignUrl failed: %v", err)
+	}
+
+	store := fakeKeyStore{clientID: "clientID", entry: KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey}}
+	if _, _, e := Authenticate(store, signedUrl, nil, nil); e != nil {
+		t.Errorf("Authenticate rejected a validly signed request against a custom KeyRepositoryStore: %v", e)
+	}
+}
+
+func TestAuthenticateForgedSignatureDoesNotPoisonNonce(t *testing.T) {
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	nonces := NewMemoryNonceStore(nil)
+
+	forgedUrl := kUrl + "&nonce=shared-nonce&signature=garbage"
+	if _, _, e := r.Authenticate(forgedUrl, nil, nonces); e == nil {
+		t.Fatalf("Authenticate accepted a forged signature")
+	}
+
+	signedUrl, err := SignUrl(kUrl, kPrivateKey, time.Time{}, "shared-nonce")
+	if err != nil {
+		t.Fatalf("SignUrl failed: %v", err)
+	}
+	if _, _, e := r.Authenticate(signedUrl, nil, nonces); e != nil {
+		t.Errorf("Authenticate rejected a validly signed request whose nonce a prior forged request had tried to consume: %v", e)
+	}
+}
@@ -0,0 +1,80 @@
+package bizapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareAndSigningTransportRoundTrip(t *testing.T) {
+	auth := &Authenticator{Repository: newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})}
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, _ := ClientIDFromContext(r.Context())
+		io.WriteString(w, clientID)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Transport: NewSigningTransport("clientID", kPrivateKey, HMACSHA1, nil)}
+	resp, e := client.Post(server.URL+"/resource", "text/plain", strings.NewReader("request body"))
+	if e != nil {
+		t.Fatalf("client.Post failed: %v", e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "clientID" {
+		t.Errorf("Expecting resolved client ID %q, got %q", "clientID", body)
+	}
+}
+
+func TestMiddlewareAndSigningTransportRoundTripRSASHA256(t *testing.T) {
+	private, public, e := GenerateKey(RSASHA256)
+	if e != nil {
+		t.Fatalf("GenerateKey(RSASHA256) failed: %v", e)
+	}
+
+	auth := &Authenticator{Repository: newRepo("clientID", KeyEntry{Algorithm: RSASHA256, Key: public})}
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, _ := ClientIDFromContext(r.Context())
+		io.WriteString(w, clientID)
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := &http.Client{Transport: NewSigningTransport("clientID", private, RSASHA256, nil)}
+	resp, e := client.Post(server.URL+"/resource", "text/plain", strings.NewReader("request body"))
+	if e != nil {
+		t.Fatalf("client.Post failed: %v", e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "clientID" {
+		t.Errorf("Expecting resolved client ID %q, got %q", "clientID", body)
+	}
+}
+
+func TestMiddlewareRejectsUnsignedRequest(t *testing.T) {
+	auth := &Authenticator{Repository: newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})}
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("next handler should not run for an unsigned request")
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, e := http.Get(server.URL + "/resource")
+	if e != nil {
+		t.Fatalf("http.Get failed: %v", e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expecting 401, got %d", resp.StatusCode)
+	}
+}
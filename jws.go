@@ -0,0 +1,233 @@
+package bizapi
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// JWSProtectedHeader is the protected header of a JWS envelope created
+// by CreateJWSEnvelope.  It plays the role that the "client", "kid" and
+// "alg" query parameters play for signed URLs: Algorithm picks the
+// Verifier, KeyID names the client whose KeyRepository entry holds the
+// verification material, RotationKeyID, if set, selects which of that
+// client's (possibly rotated) keys to verify against, the same way the
+// "kid" query parameter does for Authenticate, IssuedAt records when the
+// envelope was created, and Expires, if non-zero, is the Unix timestamp
+// after which VerifyJWSEnvelope must reject it.
+type JWSProtectedHeader struct {
+	Algorithm     Algorithm `json:"alg"`
+	KeyID         string    `json:"kid"`
+	RotationKeyID string    `json:"rkid,omitempty"`
+	IssuedAt      int64     `json:"iat"`
+	Expires       int64     `json:"exp,omitempty"`
+}
+
+// jwsUnprotectedHeader is the envelope's unprotected header.  It is not
+// covered by the signature, so it must never carry anything the
+// signature needs to protect; it exists here only to carry an optional
+// X.509 certificate chain so that a verifier can establish trust via a
+// CA bundle (see VerifyJWSEnvelopeWithCAPool) instead of a flat
+// KeyRepository file.
+type jwsUnprotectedHeader struct {
+	// X5C holds the signer's certificate chain, leaf first, each entry
+	// standard (non-URL-safe) base64-encoded DER, per RFC 7515 §4.1.6.
+	X5C []string `json:"x5c,omitempty"`
+}
+
+// jwsEnvelope is the JSON Serialization of a JWS, RFC 7515 §7.2.
+type jwsEnvelope struct {
+	Payload   string                `json:"payload"`
+	Protected string                `json:"protected"`
+	Header    *jwsUnprotectedHeader `json:"header,omitempty"`
+	Signature string                `json:"signature"`
+}
+
+// CreateJWSEnvelope signs payload with key, producing a detached JWS
+// envelope: JSON { "payload", "protected", "signature" }, each
+// base64url encoded per RFC 7515, where the signing input is
+// base64url(protected) + "." + base64url(payload).  hdr.Algorithm picks
+// the Signer and key should be the blob that Signer expects.  If
+// certChain is non-empty, the envelope carries it (leaf first, DER
+// encoded) in an unprotected "x5c" header for VerifyJWSEnvelopeWithCAPool.
+func CreateJWSEnvelope(payload []byte, key string, hdr JWSProtectedHeader, certChain ...[]byte) ([]byte, error) {
+	protectedJSON, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %v", err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(protectedJSON)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	signingInput := protected + "." + encodedPayload
+
+	signer, err := NewSigner(hdr.Algorithm, key)
+	if err != nil {
+		return nil, fmt.Errorf("NewSigner failed: %v", err)
+	}
+	signature, err := signer.Sign([]byte(signingInput))
+	if err != nil {
+		return nil, fmt.Errorf("Sign failed: %v", err)
+	}
+
+	env := jwsEnvelope{
+		Payload:   encodedPayload,
+		Protected: protected,
+		Signature: base64.RawURLEncoding.EncodeToString(signature),
+	}
+	if len(certChain) > 0 {
+		x5c := make([]string, len(certChain))
+		for i, der := range certChain {
+			x5c[i] = base64.StdEncoding.EncodeToString(der)
+		}
+		env.Header = &jwsUnprotectedHeader{X5C: x5c}
+	}
+	return json.Marshal(env)
+}
+
+// decodeJWSEnvelope parses env and its protected header, and checks the
+// expiration carried by the protected header, common work shared by
+// VerifyJWSEnvelope and VerifyJWSEnvelopeWithCAPool.
+func decodeJWSEnvelope(env []byte) (*jwsEnvelope, JWSProtectedHeader, error) {
+	var envelope jwsEnvelope
+	if e := json.Unmarshal(env, &envelope); e != nil {
+		return nil, JWSProtectedHeader{}, fmt.Errorf("json.Unmarshal failed: %v", e)
+	}
+
+	protectedJSON, e := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if e != nil {
+		return nil, JWSProtectedHeader{}, fmt.Errorf("base64.RawURLEncoding.DecodeString(protected) failed: %v", e)
+	}
+	var hdr JWSProtectedHeader
+	if e := json.Unmarshal(protectedJSON, &hdr); e != nil {
+		return nil, JWSProtectedHeader{}, fmt.Errorf("json.Unmarshal(protected header) failed: %v", e)
+	}
+	if hdr.Expires != 0 && time.Now().Unix() > hdr.Expires {
+		return nil, JWSProtectedHeader{}, fmt.Errorf("JWS envelope expired at %d", hdr.Expires)
+	}
+	return &envelope, hdr, nil
+}
+
+// verifyJWSSignature checks envelope's signature over its signing input
+// using verifier, and returns the decoded payload.
+func verifyJWSSignature(envelope *jwsEnvelope, verifier Verifier) ([]byte, error) {
+	signature, e := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if e != nil {
+		return nil, fmt.Errorf("base64.RawURLEncoding.DecodeString(signature) failed: %v", e)
+	}
+	signingInput := envelope.Protected + "." + envelope.Payload
+	if e := verifier.Verify([]byte(signingInput), signature); e != nil {
+		return nil, fmt.Errorf("signature verification failed: %v", e)
+	}
+	payload, e := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if e != nil {
+		return nil, fmt.Errorf("base64.RawURLEncoding.DecodeString(payload) failed: %v", e)
+	}
+	return payload, nil
+}
+
+// VerifyJWSEnvelope verifies a detached JWS envelope created by
+// CreateJWSEnvelope against the store entry named by the envelope's
+// "kid" (and "rkid", if the client has rotated keys), the same way
+// Authenticate verifies a signed URL against its "client" (and "kid").
+// It rejects an envelope whose "alg" disagrees with what is configured
+// for that client, and one whose "exp" (if present) has passed.  store
+// is consulted via KeyRepositoryStore, so a caller can back it with a
+// database or a KMS instead of an in-memory KeyRepository.
+func VerifyJWSEnvelope(store KeyRepositoryStore, env []byte) (payload []byte, clientID string, err error) {
+	envelope, hdr, e := decodeJWSEnvelope(env)
+	if e != nil {
+		return nil, "", e
+	}
+
+	entry, e := lookupKey(store, hdr.KeyID, hdr.RotationKeyID, time.Now())
+	if e != nil {
+		return nil, "", e
+	}
+	if hdr.Algorithm != entry.algorithm() {
+		return nil, "", fmt.Errorf("alg %q does not match the algorithm configured for client %s", hdr.Algorithm, hdr.KeyID)
+	}
+
+	verifier, e := NewVerifier(entry.algorithm(), entry.Key)
+	if e != nil {
+		return nil, "", fmt.Errorf("NewVerifier failed: %v", e)
+	}
+	payload, e = verifyJWSSignature(envelope, verifier)
+	if e != nil {
+		return nil, "", e
+	}
+	return payload, hdr.KeyID, nil
+}
+
+// VerifyJWSEnvelope is KeyRepository's convenience wrapper around the
+// package-level VerifyJWSEnvelope, so callers with an in-memory
+// repository can call r.VerifyJWSEnvelope(...) directly.
+func (c *KeyRepository) VerifyJWSEnvelope(env []byte) (payload []byte, clientID string, err error) {
+	return VerifyJWSEnvelope(c, env)
+}
+
+// VerifyJWSEnvelopeWithCAPool verifies a detached JWS envelope whose
+// unprotected header carries an "x5c" certificate chain (see
+// CreateJWSEnvelope), establishing trust via roots instead of a
+// KeyRepository entry: the leaf certificate must chain up to roots, and
+// its public key is what verifies the envelope's signature.  This lets
+// deployments that wrap RSA or Ed25519 keys in certificates distribute
+// trust as a CA bundle instead of a flat per-client key file.
+func VerifyJWSEnvelopeWithCAPool(env []byte, roots *x509.CertPool) (payload []byte, clientID string, err error) {
+	envelope, hdr, e := decodeJWSEnvelope(env)
+	if e != nil {
+		return nil, "", e
+	}
+	if envelope.Header == nil || len(envelope.Header.X5C) == 0 {
+		return nil, "", errors.New("JWS envelope has no x5c certificate chain")
+	}
+
+	certs := make([]*x509.Certificate, len(envelope.Header.X5C))
+	for i, encoded := range envelope.Header.X5C {
+		der, e := base64.StdEncoding.DecodeString(encoded)
+		if e != nil {
+			return nil, "", fmt.Errorf("base64.StdEncoding.DecodeString(x5c[%d]) failed: %v", i, e)
+		}
+		cert, e := x509.ParseCertificate(der)
+		if e != nil {
+			return nil, "", fmt.Errorf("x509.ParseCertificate(x5c[%d]) failed: %v", i, e)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, e := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); e != nil {
+		return nil, "", fmt.Errorf("certificate chain did not verify against the CA pool: %v", e)
+	}
+
+	var verifier Verifier
+	switch hdr.Algorithm {
+	case RSASHA256:
+		public, ok := leaf.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, "", errors.New("leaf certificate does not hold an RSA public key")
+		}
+		verifier = rsaVerifier{public}
+	case Ed25519:
+		public, ok := leaf.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return nil, "", errors.New("leaf certificate does not hold an Ed25519 public key")
+		}
+		verifier = ed25519Verifier{public}
+	default:
+		return nil, "", fmt.Errorf("x5c trust is only supported for RSA-SHA256 and Ed25519, got %s", hdr.Algorithm)
+	}
+
+	payload, e = verifyJWSSignature(envelope, verifier)
+	if e != nil {
+		return nil, "", e
+	}
+	return payload, hdr.KeyID, nil
+}
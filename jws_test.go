@@ -0,0 +1,153 @@
+package bizapi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCreateAndVerifyJWSEnvelope(t *testing.T) {
+	hdr := JWSProtectedHeader{Algorithm: HMACSHA1, KeyID: "clientID", IssuedAt: time.Now().Unix()}
+	env, e := CreateJWSEnvelope([]byte("hello, world"), kPrivateKey, hdr)
+	if e != nil {
+		t.Fatalf("CreateJWSEnvelope failed: %v", e)
+	}
+
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	payload, clientID, e := r.VerifyJWSEnvelope(env)
+	if e != nil {
+		t.Fatalf("VerifyJWSEnvelope failed: %v", e)
+	}
+	if string(payload) != "hello, world" {
+		t.Errorf("Expecting payload %q, got %q", "hello, world", payload)
+	}
+	if clientID != "clientID" {
+		t.Errorf("Expecting clientID %q, got %q", "clientID", clientID)
+	}
+}
+
+func TestCreateAndVerifyJWSEnvelopeWithRotatedKey(t *testing.T) {
+	hdr := JWSProtectedHeader{Algorithm: HMACSHA1, KeyID: "clientID", RotationKeyID: "keyB", IssuedAt: time.Now().Unix()}
+	env, e := CreateJWSEnvelope([]byte("hello, world"), kPrivateKey, hdr)
+	if e != nil {
+		t.Fatalf("CreateJWSEnvelope failed: %v", e)
+	}
+
+	r := newRepo("clientID",
+		KeyEntry{KeyID: "keyA", Algorithm: HMACSHA1, Key: "someOtherKey"},
+		KeyEntry{KeyID: "keyB", Algorithm: HMACSHA1, Key: kPrivateKey},
+	)
+	payload, clientID, e := r.VerifyJWSEnvelope(env)
+	if e != nil {
+		t.Fatalf("VerifyJWSEnvelope failed: %v", e)
+	}
+	if string(payload) != "hello, world" || clientID != "clientID" {
+		t.Errorf("Expecting (%q, %q), got (%q, %q)", "hello, world", "clientID", payload, clientID)
+	}
+
+	if _, _, e := r.VerifyJWSEnvelope(env); e != nil {
+		t.Errorf("unexpected re-verification failure: %v", e)
+	}
+
+	unknownKid := JWSProtectedHeader{Algorithm: HMACSHA1, KeyID: "clientID", RotationKeyID: "keyC", IssuedAt: time.Now().Unix()}
+	badEnv, e := CreateJWSEnvelope([]byte("hello, world"), kPrivateKey, unknownKid)
+	if e != nil {
+		t.Fatalf("CreateJWSEnvelope failed: %v", e)
+	}
+	if _, _, e := r.VerifyJWSEnvelope(badEnv); !errors.Is(e, ErrUnknownKeyID) {
+		t.Errorf("Expecting ErrUnknownKeyID for an unrotated rkid, got %v", e)
+	}
+}
+
+func TestVerifyJWSEnvelopeRejectsExpired(t *testing.T) {
+	hdr := JWSProtectedHeader{
+		Algorithm: HMACSHA1,
+		KeyID:     "clientID",
+		IssuedAt:  time.Now().Add(-time.Hour).Unix(),
+		Expires:   time.Now().Add(-time.Minute).Unix(),
+	}
+	env, e := CreateJWSEnvelope([]byte("hello, world"), kPrivateKey, hdr)
+	if e != nil {
+		t.Fatalf("CreateJWSEnvelope failed: %v", e)
+	}
+
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	if _, _, e := r.VerifyJWSEnvelope(env); e == nil {
+		t.Errorf("VerifyJWSEnvelope accepted an expired envelope")
+	}
+}
+
+func TestVerifyJWSEnvelopeRejectsAlgorithmConfusion(t *testing.T) {
+	hdr := JWSProtectedHeader{Algorithm: HMACSHA1, KeyID: "clientID", IssuedAt: time.Now().Unix()}
+	env, e := CreateJWSEnvelope([]byte("hello, world"), kPrivateKey, hdr)
+	if e != nil {
+		t.Fatalf("CreateJWSEnvelope failed: %v", e)
+	}
+
+	// The repository says this client actually uses HMACSHA256.
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA256, Key: kPrivateKey})
+	if _, _, e := r.VerifyJWSEnvelope(env); e == nil {
+		t.Errorf("VerifyJWSEnvelope accepted an alg that disagreed with the repository")
+	}
+}
+
+func TestVerifyJWSEnvelopeWithCAPool(t *testing.T) {
+	caKey, e := rsa.GenerateKey(rand.Reader, 2048)
+	if e != nil {
+		t.Fatalf("rsa.GenerateKey failed: %v", e)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, e := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if e != nil {
+		t.Fatalf("x509.CreateCertificate(ca) failed: %v", e)
+	}
+	caCert, e := x509.ParseCertificate(caDER)
+	if e != nil {
+		t.Fatalf("x509.ParseCertificate(ca) failed: %v", e)
+	}
+
+	leafPub, leafPriv, e := ed25519.GenerateKey(rand.Reader)
+	if e != nil {
+		t.Fatalf("ed25519.GenerateKey failed: %v", e)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "clientID"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	leafDER, e := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, leafPub, caKey)
+	if e != nil {
+		t.Fatalf("x509.CreateCertificate(leaf) failed: %v", e)
+	}
+
+	hdr := JWSProtectedHeader{Algorithm: Ed25519, KeyID: "clientID", IssuedAt: time.Now().Unix()}
+	env, e := CreateJWSEnvelope([]byte("hello, world"), EncodeUrlSafeBase64(leafPriv), hdr, leafDER)
+	if e != nil {
+		t.Fatalf("CreateJWSEnvelope failed: %v", e)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	payload, clientID, e := VerifyJWSEnvelopeWithCAPool(env, roots)
+	if e != nil {
+		t.Fatalf("VerifyJWSEnvelopeWithCAPool failed: %v", e)
+	}
+	if string(payload) != "hello, world" || clientID != "clientID" {
+		t.Errorf("Expecting (%q, %q), got (%q, %q)", "hello, world", "clientID", payload, clientID)
+	}
+}
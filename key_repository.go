@@ -0,0 +1,195 @@
+package bizapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyEntry is one signing/verification key configured for a client: a
+// shared secret for the HMAC algorithms, or a public key for the
+// asymmetric ones, tagged with the Algorithm it is used with.  KeyID
+// distinguishes it from a client's other keys during rotation and is
+// carried in signed URLs as the "kid" query parameter; the zero value
+// "" is the implicit kid of a client with a single, non-rotating key,
+// matching the original KeyRepository file format.  NotBefore and
+// NotAfter bound when the key is valid; the zero time.Time for either
+// means "no bound".
+type KeyEntry struct {
+	KeyID     string
+	Algorithm Algorithm
+	Key       string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// algorithm returns e.Algorithm, defaulting to HMACSHA1 for entries
+// loaded from a legacy KeyRepository line that does not name one.
+func (e KeyEntry) algorithm() Algorithm {
+	if e.Algorithm == "" {
+		return HMACSHA1
+	}
+	return e.Algorithm
+}
+
+// Sentinel errors distinguishing why a rotation-aware key lookup
+// failed, so callers (and operators debugging a rotation) don't see
+// every case collapse into one generic "bad signature" error.  Test
+// with errors.Is.
+var (
+	ErrUnknownClient = errors.New("unknown client")
+	ErrUnknownKeyID  = errors.New("unknown kid")
+	ErrKeyExpired    = errors.New("kid expired")
+)
+
+// KeyRepositoryStore is the lookup KeyRepository itself performs, split
+// out as an interface so operators can back it with a database or a
+// KMS instead of the in-memory map LoadKeyRepository builds from a
+// file.  Keys returns every KeyEntry configured for clientID (so the
+// caller can pick the one matching a signed request's "kid"), or an
+// error wrapping ErrUnknownClient if there are none.
+type KeyRepositoryStore interface {
+	Keys(clientID string) ([]KeyEntry, error)
+}
+
+// KeyRepository maps client ID to the list of KeyEntry values that
+// client may sign with, supporting key rotation: a client can have
+// several active entries at once, distinguished by KeyID, so requests
+// signed with either an old or a new key keep authenticating during
+// rollout.  A KeyRepository is safe for concurrent use: Keys (and so
+// Authenticate, AuthenticateRequest, and VerifyJWSEnvelope) may be
+// called concurrently with Rotate, e.g. to roll a key while the service
+// keeps serving traffic.  The zero value is not usable; construct one
+// with NewKeyRepository or LoadKeyRepository.
+type KeyRepository struct {
+	mu      sync.RWMutex
+	entries map[string][]KeyEntry
+}
+
+// NewKeyRepository creates an empty KeyRepository, ready for Rotate to
+// populate.
+func NewKeyRepository() *KeyRepository {
+	return &KeyRepository{entries: make(map[string][]KeyEntry)}
+}
+
+// Keys implements KeyRepositoryStore.
+func (c *KeyRepository) Keys(clientID string) ([]KeyEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries, present := c.entries[clientID]
+	if !present || len(entries) == 0 {
+		return nil, fmt.Errorf("client %q: %w", clientID, ErrUnknownClient)
+	}
+	return entries, nil
+}
+
+// Rotate appends newKey to clientID's list of keys, so requests signed
+// with either the old or the new key continue to authenticate during
+// rollout.  It is the caller's responsibility to eventually retire the
+// old key, e.g. by setting its NotAfter and reloading the repository.
+func (c *KeyRepository) Rotate(clientID string, newKey KeyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[clientID] = append(c.entries[clientID], newKey)
+}
+
+// lookupKey finds the KeyEntry for (clientID, keyID) that is valid at
+// time at, against any KeyRepositoryStore.  It distinguishes
+// ErrUnknownClient, ErrUnknownKeyID, and ErrKeyExpired so that
+// Authenticate, AuthenticateRequest, and VerifyJWSEnvelope don't hide
+// rotation bugs behind a generic signature-mismatch error.
+func lookupKey(store KeyRepositoryStore, clientID, keyID string, at time.Time) (KeyEntry, error) {
+	entries, e := store.Keys(clientID)
+	if e != nil {
+		return KeyEntry{}, e
+	}
+
+	sawKeyID := false
+	for _, entry := range entries {
+		if entry.KeyID != keyID {
+			continue
+		}
+		sawKeyID = true
+		if !entry.NotBefore.IsZero() && at.Before(entry.NotBefore) {
+			continue
+		}
+		if !entry.NotAfter.IsZero() && at.After(entry.NotAfter) {
+			continue
+		}
+		return entry, nil
+	}
+	if sawKeyID {
+		return KeyEntry{}, fmt.Errorf("client %q kid %q: %w", clientID, keyID, ErrKeyExpired)
+	}
+	return KeyEntry{}, fmt.Errorf("client %q kid %q: %w", clientID, keyID, ErrUnknownKeyID)
+}
+
+// lookupKey is KeyRepository's own convenience wrapper around the
+// package-level lookupKey, so code holding a *KeyRepository can call
+// c.lookupKey(...) directly.
+func (c *KeyRepository) lookupKey(clientID, keyID string, at time.Time) (KeyEntry, error) {
+	return lookupKey(c, clientID, keyID, at)
+}
+
+// LoadKeyRepository loads client ID and key entries.  Then people can
+// call Authenticate to check whether a request URL is valid.  Each
+// non-empty, non-comment line is one of:
+//
+//	clientID key                                           (legacy, implies HMACSHA1, kid "")
+//	clientID algorithm key                                 (implies kid "")
+//	clientID keyID algorithm key notBeforeUnix notAfterUnix (full rotation schema; 0 means unbounded)
+func LoadKeyRepository(reader io.Reader) (*KeyRepository, error) {
+	repo := NewKeyRepository()
+	s := bufio.NewScanner(reader)
+	for s.Scan() {
+		line := s.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, " ")
+		switch len(fields) {
+		case 2:
+			repo.Rotate(fields[0], KeyEntry{Algorithm: HMACSHA1, Key: fields[1]})
+		case 3:
+			repo.Rotate(fields[0], KeyEntry{Algorithm: Algorithm(fields[1]), Key: fields[2]})
+		case 6:
+			notBefore, e := parseUnixOrZero(fields[4])
+			if e != nil {
+				return nil, fmt.Errorf("invalid notBefore %q: %v", fields[4], e)
+			}
+			notAfter, e := parseUnixOrZero(fields[5])
+			if e != nil {
+				return nil, fmt.Errorf("invalid notAfter %q: %v", fields[5], e)
+			}
+			repo.Rotate(fields[0], KeyEntry{
+				KeyID:     fields[1],
+				Algorithm: Algorithm(fields[2]),
+				Key:       fields[3],
+				NotBefore: notBefore,
+				NotAfter:  notAfter,
+			})
+		default:
+			return nil, fmt.Errorf("Every line must contain 2, 3, or 6 fields separated by a space: %s", line)
+		}
+	}
+	return repo, nil
+}
+
+// parseUnixOrZero parses s as a Unix timestamp, treating "0" as the
+// zero time.Time (meaning "unbounded" for KeyEntry.NotBefore/NotAfter).
+func parseUnixOrZero(s string) (time.Time, error) {
+	unix, e := strconv.ParseInt(s, 10, 64)
+	if e != nil {
+		return time.Time{}, e
+	}
+	if unix == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(unix, 0), nil
+}
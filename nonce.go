@@ -0,0 +1,72 @@
+package bizapi
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time.  Authenticate uses it to decide
+// whether a signed URL's "expires" parameter has passed.  Production
+// code can leave it nil to use the real wall clock; tests can inject a
+// fake Clock to make expiration checks deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock implements Clock using the standard library's time.Now.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// NonceStore records nonces carried by signed URLs so that Authenticate
+// can reject replayed requests.  Seen reports whether nonce has already
+// been recorded; if not, it records nonce together with exp, the time
+// after which the nonce may be forgotten.
+type NonceStore interface {
+	Seen(nonce string, exp time.Time) (bool, error)
+}
+
+// MemoryNonceStore is a NonceStore backed by an in-memory map.  Entries
+// are evicted once their expiration has passed, so the map does not
+// grow without bound as long as signed URLs carry an "expires"
+// parameter.  Use NewMemoryNonceStore to construct one.
+type MemoryNonceStore struct {
+	mu     sync.Mutex
+	clock  Clock
+	nonces map[string]time.Time
+}
+
+// NewMemoryNonceStore creates a MemoryNonceStore.  clock may be nil, in
+// which case the real wall clock is used to decide which entries have
+// expired.
+func NewMemoryNonceStore(clock Clock) *MemoryNonceStore {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &MemoryNonceStore{clock: clock, nonces: make(map[string]time.Time)}
+}
+
+// Seen implements NonceStore.
+func (s *MemoryNonceStore) Seen(nonce string, exp time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictExpiredLocked()
+
+	if _, present := s.nonces[nonce]; present {
+		return true, nil
+	}
+	s.nonces[nonce] = exp
+	return false, nil
+}
+
+// evictExpiredLocked removes nonces whose expiration has passed.  The
+// caller must hold s.mu.
+func (s *MemoryNonceStore) evictExpiredLocked() {
+	now := s.clock.Now()
+	for nonce, exp := range s.nonces {
+		if !exp.IsZero() && now.After(exp) {
+			delete(s.nonces, nonce)
+		}
+	}
+}
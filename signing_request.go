@@ -0,0 +1,296 @@
+package bizapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningRequest describes everything CreateSignatureV2 binds into a
+// signature.  Unlike CreateSignature, which only covers a URL's path
+// and query, a SigningRequest also covers the HTTP verb, a content
+// hash, and a handful of extension headers, following the canonical
+// request used by GCS V2 signed URLs.  That way a signature is bound
+// to the actual method and body a client sent, not just the resource
+// it is requesting.
+type SigningRequest struct {
+	Method      string
+	ContentMD5  string
+	ContentType string
+	Expires     time.Time
+	Nonce       string
+	Algorithm   Algorithm         // defaults to HMACSHA1 when empty
+	Headers     map[string]string // extension headers, e.g. "x-goog-meta-foo"
+	Resource    *url.URL          // the URL being signed, as passed to CreateSignature
+}
+
+// algorithm returns req.Algorithm, defaulting to HMACSHA1.
+func (req *SigningRequest) algorithm() Algorithm {
+	if req.Algorithm == "" {
+		return HMACSHA1
+	}
+	return req.Algorithm
+}
+
+// canonicalHeaders returns req.Headers sorted by lower-cased header
+// name and formatted as "name:value\n" lines, as required by the V2
+// canonical request.
+func (req *SigningRequest) canonicalHeaders() string {
+	lowered := make(map[string]string, len(req.Headers))
+	names := make([]string, 0, len(req.Headers))
+	for name, value := range req.Headers {
+		lower := strings.ToLower(name)
+		lowered[lower] = value
+		names = append(names, lower)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s:%s\n", name, lowered[name])
+	}
+	return buf.String()
+}
+
+// canonicalBytes builds the bytes CreateSignatureV2/AuthenticateRequest
+// sign or verify: "Method\nContentMD5\nContentType\nExpires\n" followed
+// by sorted "header:value\n" lines and then the resource (req.Resource's
+// path and query, with req.Nonce appended the same way CreateSignature
+// appends one).
+func (req *SigningRequest) canonicalBytes() []byte {
+	var expiresUnix int64
+	if !req.Expires.IsZero() {
+		expiresUnix = req.Expires.Unix()
+	}
+
+	var canonical bytes.Buffer
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n%d\n", req.Method, req.ContentMD5, req.ContentType, expiresUnix)
+	canonical.WriteString(req.canonicalHeaders())
+	canonical.WriteString(req.Resource.Path + "?" + req.Resource.RawQuery)
+	if req.Nonce != "" {
+		canonical.WriteString("&nonce=" + req.Nonce)
+	}
+	return canonical.Bytes()
+}
+
+// CreateSignatureV2 computes a signature over the extended canonical
+// request described by req, using req.Algorithm (HMACSHA1 if unset).
+// key should be the blob a Signer for that algorithm expects: a shared
+// secret for the HMAC algorithms, or a private key for the asymmetric
+// ones.
+func CreateSignatureV2(req *SigningRequest, key string) (string, error) {
+	if req.Resource == nil {
+		return "", errors.New("SigningRequest.Resource must not be nil")
+	}
+
+	values, err := url.ParseQuery(req.Resource.RawQuery)
+	if err != nil {
+		return "", fmt.Errorf("url.ParseQuery failed: %v", err)
+	}
+	if _, presents := values["client"]; !presents {
+		return "", errors.New("A to-be-encoded URL must have the client query")
+	}
+	if _, presents := values["signature"]; presents {
+		return "", errors.New("A to-be-encoded URL must NOT have the signature query")
+	}
+
+	signer, err := NewSigner(req.algorithm(), key)
+	if err != nil {
+		return "", fmt.Errorf("NewSigner failed: %v", err)
+	}
+	signature, err := signer.Sign(req.canonicalBytes())
+	if err != nil {
+		return "", fmt.Errorf("Sign failed: %v", err)
+	}
+	return EncodeUrlSafeBase64(signature), nil
+}
+
+// SignRequest signs req with key using CreateSignatureV2, and returns
+// req.Resource with "expires"/"nonce" (if set), an "alg" parameter
+// naming req.Algorithm, a "sigv=2" marker, and "signature" attached as
+// query parameters.  "alg" lets AuthenticateRequest pick the matching
+// Verifier and reject algorithm-confusion attempts; "sigv=2" lets it
+// recognize a V2-signed URL and verify over the extended canonical
+// request rather than treating it as a plain CreateSignature URL.
+func SignRequest(req *SigningRequest, key string) (string, error) {
+	signature, e := CreateSignatureV2(req, key)
+	if e != nil {
+		return "", fmt.Errorf("CreateSignatureV2 failed: %v", e)
+	}
+
+	u := req.Resource
+	signedUrl := u.Scheme + "://" + u.Host + u.Path + "?" + u.RawQuery
+	if !req.Expires.IsZero() {
+		signedUrl += fmt.Sprintf("&expires=%d", req.Expires.Unix())
+	}
+	if req.Nonce != "" {
+		signedUrl += "&nonce=" + req.Nonce
+	}
+	signedUrl += "&alg=" + string(req.algorithm())
+	return signedUrl + "&sigv=2&signature=" + signature, nil
+}
+
+// AuthenticateRequest is the V2 counterpart of Authenticate: it verifies
+// a request signed by SignRequest using the method, content hash, and
+// extension headers of the request as actually received, rather than
+// trusting only the URL.  req.Resource must be the full signed URL
+// (including "expires", "nonce", "sigv" and "signature").  clock and
+// nonces behave as they do for Authenticate.  store is consulted via
+// KeyRepositoryStore, so a caller can back it with a database or a KMS
+// instead of an in-memory KeyRepository.
+func AuthenticateRequest(store KeyRepositoryStore, req *SigningRequest, clock Clock, nonces NonceStore) (url.Values, error) {
+	if req.Resource == nil {
+		return nil, errors.New("SigningRequest.Resource must not be nil")
+	}
+
+	rawUrl := req.Resource.String()
+	values, e := url.ParseQuery(req.Resource.RawQuery)
+	if e != nil {
+		return nil, fmt.Errorf("url.ParseQuery failed: %v", e)
+	}
+	if v, present := values["client"]; !present || len(v) != 1 {
+		return nil, errors.New("Request URL must contain exactly one \"client\" parameter.")
+	}
+	if v, present := values["sigv"]; !present || len(v) != 1 || v[0] != "2" {
+		return nil, errors.New("Request URL must contain a \"sigv=2\" parameter.")
+	}
+	if v, present := values["signature"]; !present || len(v) != 1 {
+		return nil, errors.New("Request URL must contain exactly one \"signature\" parameter.")
+	}
+
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	var kid string
+	if v, present := values["kid"]; present && len(v) == 1 {
+		kid = v[0]
+	}
+	entry, e := lookupKey(store, values["client"][0], kid, clock.Now())
+	if e != nil {
+		return nil, e
+	}
+	if v, present := values["alg"]; !present || len(v) != 1 {
+		return nil, errors.New("Request URL must contain exactly one \"alg\" parameter.")
+	} else if Algorithm(v[0]) != entry.algorithm() {
+		return nil, fmt.Errorf("alg %q does not match the algorithm configured for client %s",
+			v[0], values["client"][0])
+	}
+
+	var expires time.Time
+	if v, present := values["expires"]; present && len(v) == 1 {
+		unix, e := strconv.ParseInt(v[0], 10, 64)
+		if e != nil {
+			return nil, fmt.Errorf("invalid expires query %q: %v", v[0], e)
+		}
+		expires = time.Unix(unix, 0)
+		if clock.Now().After(expires) {
+			return nil, fmt.Errorf("signed URL expired at %v", expires)
+		}
+	}
+
+	var nonce string
+	if v, present := values["nonce"]; present && len(v) == 1 {
+		nonce = v[0]
+	}
+
+	attachedSignature := values["signature"][0]
+
+	rawQuery := req.Resource.RawQuery
+	for _, suffix := range []string{"&signature=" + attachedSignature, "&sigv=2", "&alg=" + values["alg"][0]} {
+		i := strings.LastIndex(rawQuery, suffix)
+		if i == -1 {
+			return nil, fmt.Errorf("Cannot find %s in request URL: %s", suffix, rawUrl)
+		}
+		rawQuery = rawQuery[0:i]
+	}
+	if nonce != "" {
+		i := strings.LastIndex(rawQuery, "&nonce="+nonce)
+		if i == -1 {
+			return nil, fmt.Errorf("Cannot find &nonce= in request URL: %s", rawUrl)
+		}
+		rawQuery = rawQuery[0:i]
+	}
+	if !expires.IsZero() {
+		suffix := fmt.Sprintf("&expires=%d", expires.Unix())
+		i := strings.LastIndex(rawQuery, suffix)
+		if i == -1 {
+			return nil, fmt.Errorf("Cannot find &expires= in request URL: %s", rawUrl)
+		}
+		rawQuery = rawQuery[0:i]
+	}
+
+	recomputed := &SigningRequest{
+		Method:      req.Method,
+		ContentMD5:  req.ContentMD5,
+		ContentType: req.ContentType,
+		Expires:     expires,
+		Nonce:       nonce,
+		Algorithm:   entry.algorithm(),
+		Headers:     req.Headers,
+		Resource:    &url.URL{Path: req.Resource.Path, RawQuery: rawQuery},
+	}
+
+	signatureBytes, e := DecodeUrlSafeBase64(attachedSignature)
+	if e != nil {
+		return nil, fmt.Errorf("DecodeUrlSafeBase64 failed: %v", e)
+	}
+	verifier, e := NewVerifier(entry.algorithm(), entry.Key)
+	if e != nil {
+		return nil, fmt.Errorf("NewVerifier failed: %v", e)
+	}
+	if e := verifier.Verify(recomputed.canonicalBytes(), signatureBytes); e != nil {
+		return nil, fmt.Errorf("signature verification failed: %v", e)
+	}
+
+	// Only an authenticated request gets to consume a nonce slot: a
+	// forged request with a bad signature must not be able to mark a
+	// nonce as seen and so lock out the legitimate, correctly-signed
+	// request that uses it.
+	if nonce != "" && nonces != nil {
+		seen, e := nonces.Seen(nonce, expires)
+		if e != nil {
+			return nil, fmt.Errorf("NonceStore.Seen failed: %v", e)
+		}
+		if seen {
+			return nil, fmt.Errorf("nonce %q has already been used", nonce)
+		}
+	}
+
+	return values, nil
+}
+
+// AuthenticateRequest is KeyRepository's convenience wrapper around the
+// package-level AuthenticateRequest, so callers with an in-memory
+// repository can call r.AuthenticateRequest(...) directly.
+func (c *KeyRepository) AuthenticateRequest(req *SigningRequest, clock Clock, nonces NonceStore) (url.Values, error) {
+	return AuthenticateRequest(c, req, clock, nonces)
+}
+
+// NewSigningRequestFromHTTP builds a SigningRequest from an *http.Request,
+// covering its method, "Content-MD5" and "Content-Type" headers, and
+// whichever of extensionHeaders are present on it.  The caller supplies
+// expires and nonce, since an *http.Request carries neither.
+func NewSigningRequestFromHTTP(req *http.Request, extensionHeaders []string, expires time.Time, nonce string) *SigningRequest {
+	headers := make(map[string]string, len(extensionHeaders))
+	for _, name := range extensionHeaders {
+		if v := req.Header.Get(name); v != "" {
+			headers[name] = v
+		}
+	}
+	return &SigningRequest{
+		Method:      req.Method,
+		ContentMD5:  req.Header.Get("Content-MD5"),
+		ContentType: req.Header.Get("Content-Type"),
+		Expires:     expires,
+		Nonce:       nonce,
+		Headers:     headers,
+		Resource:    req.URL,
+	}
+}
@@ -0,0 +1,148 @@
+package bizapi
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateRequestRejectsNilResource(t *testing.T) {
+	r := NewKeyRepository()
+	r.Rotate("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+
+	if _, e := r.AuthenticateRequest(&SigningRequest{}, nil, nil); e == nil {
+		t.Errorf("AuthenticateRequest accepted a SigningRequest with a nil Resource")
+	}
+}
+
+func TestCreateSignatureV2RoundTrip(t *testing.T) {
+	u, _ := url.Parse(kUrl)
+	req := &SigningRequest{
+		Method:      "PUT",
+		ContentMD5:  "1B2M2Y8AsgTpgAmY7PhCfg==",
+		ContentType: "application/json",
+		Headers:     map[string]string{"X-Goog-Meta-Owner": "wyi"},
+		Resource:    u,
+	}
+
+	signedUrl, e := SignRequest(req, kPrivateKey)
+	if e != nil {
+		t.Fatalf("SignRequest failed: %v", e)
+	}
+
+	signedReq := *req
+	signedReq.Resource, _ = url.Parse(signedUrl)
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	if _, e := r.AuthenticateRequest(&signedReq, nil, nil); e != nil {
+		t.Errorf("AuthenticateRequest rejected a validly signed request: %v", e)
+	}
+}
+
+func TestAuthenticateRequestRejectsTamperedMethod(t *testing.T) {
+	u, _ := url.Parse(kUrl)
+	req := &SigningRequest{Method: "GET", Resource: u}
+	signedUrl, e := SignRequest(req, kPrivateKey)
+	if e != nil {
+		t.Fatalf("SignRequest failed: %v", e)
+	}
+
+	tampered := *req
+	tampered.Method = "POST"
+	tampered.Resource, _ = url.Parse(signedUrl)
+
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	if _, e := r.AuthenticateRequest(&tampered, nil, nil); e == nil {
+		t.Errorf("AuthenticateRequest accepted a request whose method was tampered with")
+	}
+}
+
+func TestCreateSignatureV2AsymmetricAlgorithms(t *testing.T) {
+	for _, alg := range []Algorithm{RSASHA256, Ed25519} {
+		private, public, e := GenerateKey(alg)
+		if e != nil {
+			t.Fatalf("GenerateKey(%s) failed: %v", alg, e)
+		}
+
+		u, _ := url.Parse(kUrl)
+		req := &SigningRequest{Method: "GET", Algorithm: alg, Resource: u}
+		signedUrl, e := SignRequest(req, private)
+		if e != nil {
+			t.Fatalf("SignRequest(%s) failed: %v", alg, e)
+		}
+
+		signedReq := *req
+		signedReq.Resource, _ = url.Parse(signedUrl)
+		r := newRepo("clientID", KeyEntry{Algorithm: alg, Key: public})
+		if _, e := r.AuthenticateRequest(&signedReq, nil, nil); e != nil {
+			t.Errorf("AuthenticateRequest(%s) rejected a validly signed request: %v", alg, e)
+		}
+	}
+}
+
+func TestAuthenticateRequestRejectsAlgorithmConfusion(t *testing.T) {
+	u, _ := url.Parse(kUrl)
+	req := &SigningRequest{Method: "GET", Algorithm: HMACSHA1, Resource: u}
+	signedUrl, e := SignRequest(req, kPrivateKey)
+	if e != nil {
+		t.Fatalf("SignRequest failed: %v", e)
+	}
+
+	signedReq := *req
+	signedReq.Resource, _ = url.Parse(signedUrl)
+	// The repository says this client actually uses HMACSHA256, so the
+	// HMACSHA1-signed URL's "alg" parameter must be rejected outright.
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA256, Key: kPrivateKey})
+	if _, e := r.AuthenticateRequest(&signedReq, nil, nil); e == nil {
+		t.Errorf("AuthenticateRequest accepted a signature whose alg disagreed with the repository")
+	}
+}
+
+func TestAuthenticateRequestForgedSignatureDoesNotPoisonNonce(t *testing.T) {
+	u, _ := url.Parse(kUrl)
+	r := newRepo("clientID", KeyEntry{Algorithm: HMACSHA1, Key: kPrivateKey})
+	nonces := NewMemoryNonceStore(nil)
+
+	forged := &SigningRequest{Method: "GET", Nonce: "shared-nonce", Resource: u}
+	forgedUrl, e := SignRequest(forged, kPrivateKey)
+	if e != nil {
+		t.Fatalf("SignRequest failed: %v", e)
+	}
+	tamperedReq := *forged
+	tamperedReq.Resource, _ = url.Parse(forgedUrl + "tampered")
+	if _, e := r.AuthenticateRequest(&tamperedReq, nil, nonces); e == nil {
+		t.Fatalf("AuthenticateRequest accepted a tampered signature")
+	}
+
+	u2, _ := url.Parse(kUrl)
+	legit := &SigningRequest{Method: "GET", Nonce: "shared-nonce", Resource: u2}
+	signedUrl, e := SignRequest(legit, kPrivateKey)
+	if e != nil {
+		t.Fatalf("SignRequest failed: %v", e)
+	}
+	signedReq := *legit
+	signedReq.Resource, _ = url.Parse(signedUrl)
+	if _, e := r.AuthenticateRequest(&signedReq, nil, nonces); e != nil {
+		t.Errorf("AuthenticateRequest rejected a validly signed request whose nonce a prior forged request had tried to consume: %v", e)
+	}
+}
+
+func TestNewSigningRequestFromHTTP(t *testing.T) {
+	httpReq, _ := http.NewRequest("PUT", kUrl, nil)
+	httpReq.Header.Set("Content-MD5", "1B2M2Y8AsgTpgAmY7PhCfg==")
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Goog-Meta-Owner", "wyi")
+
+	expires := time.Unix(2000000000, 0)
+	req := NewSigningRequestFromHTTP(httpReq, []string{"X-Goog-Meta-Owner"}, expires, "the-nonce")
+
+	if req.Method != "PUT" || req.ContentMD5 != "1B2M2Y8AsgTpgAmY7PhCfg==" || req.ContentType != "application/json" {
+		t.Errorf("NewSigningRequestFromHTTP did not copy method/content headers: %+v", req)
+	}
+	if req.Headers["X-Goog-Meta-Owner"] != "wyi" {
+		t.Errorf("NewSigningRequestFromHTTP did not copy extension headers: %+v", req.Headers)
+	}
+	if !req.Expires.Equal(expires) || req.Nonce != "the-nonce" {
+		t.Errorf("NewSigningRequestFromHTTP did not carry expires/nonce through: %+v", req)
+	}
+}